@@ -0,0 +1,320 @@
+package controller
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	osclient "github.com/openshift/origin/pkg/client"
+	"github.com/openshift/origin/pkg/image/api"
+)
+
+// DefaultRegistryFunc returns the default Docker registry to use for image stream tags
+// that do not specify one, and whether a default has been configured.
+type DefaultRegistryFunc func() (string, bool)
+
+// ImportController imports tag and repository metadata for an ImageStream from the
+// Docker registries referenced by its spec, and records the outcome on the stream's
+// status.
+type ImportController struct {
+	// streams provides access to ImageStreams and the ImageStreamImports used to
+	// trigger a (possibly remote) import.
+	streams osclient.Interface
+
+	// secrets resolves the pull secrets linked to a stream, if configured. A nil
+	// secrets resolver disables credential short-circuiting for scheduled imports.
+	secrets SecretResolver
+
+	// registry connects to upstream Docker registries to discover tags for streams
+	// whose Spec.DockerImageRepository is set. A nil registry disables repository
+	// scanning.
+	registry dockerRegistryClient
+
+	// limiter caps how many imports per namespace+registry may be dispatched within a
+	// window. A nil limiter imposes no cap.
+	limiter *rateLimiter
+
+	// inFlight caps how many imports may be outstanding at once across every
+	// namespace and registry. A nil inFlight imposes no cap.
+	inFlight *inFlightLimiter
+}
+
+// SetRateLimit configures a token bucket allowing up to capacity imports every window
+// for each distinct (namespace, upstream registry) pair, and a global cap of maxInFlight
+// imports outstanding at once. Passing a non-positive maxInFlight leaves the in-flight
+// cap disabled.
+func (c *ImportController) SetRateLimit(capacity int, window time.Duration, maxInFlight int) {
+	c.limiter = newRateLimiter(capacity, window)
+	if maxInFlight > 0 {
+		c.inFlight = newInFlightLimiter(maxInFlight)
+	}
+}
+
+// allowImport reports which of images on behalf of namespace may be dispatched right now
+// under the configured rate limiter, as indexes into images. A scheduled batch can span
+// several upstream registries, so each image is charged against its own registry's
+// bucket rather than the whole batch sharing the first image's. If the in-flight cap is
+// exhausted, or no image has a token available, it returns nil and leaves no in-flight
+// slot claimed. A non-empty result claims exactly one in-flight
+// slot for the batch, which the caller must release with releaseImport.
+func (c *ImportController) allowImport(namespace string, images []api.ImageImportSpec) []int {
+	if c.inFlight != nil && !c.inFlight.TryAcquire() {
+		return nil
+	}
+	if c.limiter == nil {
+		allowed := make([]int, len(images))
+		for i := range images {
+			allowed[i] = i
+		}
+		return allowed
+	}
+	var allowed []int
+	for i, image := range images {
+		key := namespace
+		if ref, err := api.ParseDockerImageReference(image.From.Name); err == nil {
+			key = namespace + "|" + ref.Registry
+		}
+		if c.limiter.Allow(key) {
+			allowed = append(allowed, i)
+		}
+	}
+	if len(allowed) == 0 {
+		c.releaseImport()
+		return nil
+	}
+	return allowed
+}
+
+// subsetImport builds an ImageStreamImport covering only the images (and their
+// correlated tags, if any) named by indexes, preserving their order. It is used to
+// dispatch the portion of a scheduled batch that allowImport actually admitted.
+func subsetImport(isi *api.ImageStreamImport, tags []string, indexes []int) (*api.ImageStreamImport, []string) {
+	subset := &api.ImageStreamImport{
+		ObjectMeta: isi.ObjectMeta,
+		Spec:       api.ImageStreamImportSpec{Import: true},
+	}
+	var subsetTags []string
+	for _, i := range indexes {
+		subset.Spec.Images = append(subset.Spec.Images, isi.Spec.Images[i])
+		if i < len(tags) {
+			subsetTags = append(subsetTags, tags[i])
+		}
+	}
+	return subset, subsetTags
+}
+
+// releaseImport returns the in-flight slot claimed by a successful allowImport call.
+func (c *ImportController) releaseImport() {
+	if c.inFlight != nil {
+		c.inFlight.Release()
+	}
+}
+
+// Next examines stream and, if any of its spec tags or its whole repository require a
+// fresh import, submits a single ImageStreamImport that covers everything outstanding.
+// defaultRegistry is not consulted: each tag is imported from the reference in its From
+// field as written, whether or not that reference names a registry.
+func (c *ImportController) Next(stream *api.ImageStream, defaultRegistry DefaultRegistryFunc) error {
+	isi := c.getImports(stream)
+	if isi == nil {
+		return nil
+	}
+	_, err := c.streams.ImageStreamImports(stream.Namespace).Create(isi)
+	return err
+}
+
+// getImports builds the ImageStreamImport that covers every tag and/or the repository
+// on stream that currently needs to be (re)imported, or returns nil if nothing is
+// outstanding.
+func (c *ImportController) getImports(stream *api.ImageStream) *api.ImageStreamImport {
+	var images []api.ImageImportSpec
+	for tag, tagRef := range stream.Spec.Tags {
+		if !tagNeedsImport(tagRef) {
+			continue
+		}
+		if !c.needsImport(stream, tag, tagRef) {
+			continue
+		}
+		images = append(images, api.ImageImportSpec{From: *tagRef.From})
+	}
+
+	importRepo := false
+	if len(stream.Spec.DockerImageRepository) > 0 {
+		if _, checked := stream.Annotations[api.DockerImageRepositoryCheckAnnotation]; !checked {
+			importRepo = true
+		}
+	}
+
+	if len(images) == 0 && !importRepo {
+		return nil
+	}
+
+	isi := &api.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{Name: stream.Name, Namespace: stream.Namespace},
+		Spec:       api.ImageStreamImportSpec{Import: true, Images: images},
+	}
+	if importRepo {
+		isi.Spec.Repository = &api.RepositoryImportSpec{
+			From: kapi.ObjectReference{Kind: "DockerImage", Name: stream.Spec.DockerImageRepository},
+		}
+	}
+	return isi
+}
+
+// tagNeedsImport reports whether tagRef points at an external Docker image that the
+// controller is responsible for importing, as opposed to a reference to another tag on
+// the same or another stream.
+func tagNeedsImport(tagRef api.TagReference) bool {
+	return !tagRef.Reference && tagRef.From != nil && tagRef.From.Kind == "DockerImage"
+}
+
+// needsImport reports whether the tag named tag on stream has to be (re)imported given
+// its spec generation and the most recent status recorded for it.
+func (c *ImportController) needsImport(stream *api.ImageStream, tag string, tagRef api.TagReference) bool {
+	if tagRef.Generation == nil {
+		return true
+	}
+	specGeneration := *tagRef.Generation
+
+	events, ok := stream.Status.Tags[tag]
+	if !ok {
+		return true
+	}
+
+	if cond := latestImportCondition(events); cond != nil && cond.Status == kapi.ConditionFalse {
+		return specGeneration > cond.Generation
+	}
+
+	if len(events.Items) > 0 {
+		return specGeneration > events.Items[0].Generation
+	}
+
+	return true
+}
+
+// latestImportCondition returns the most recently recorded ImportSuccess condition for
+// a tag, or nil if none has been recorded.
+func latestImportCondition(events api.TagEventList) *api.TagEventCondition {
+	for i := range events.Conditions {
+		if events.Conditions[i].Type == api.ImportSuccess {
+			return &events.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// scheduledImport builds the ImageStreamImport covering every tag on stream that opts
+// into scheduled background import, or returns nil if none do. tags holds, in the same
+// order as the returned isi.Spec.Images, the name of the tag each entry corresponds to -
+// callers need it to match status entries in the response back to tags.
+func (c *ImportController) scheduledImport(stream *api.ImageStream) (isi *api.ImageStreamImport, tags []string) {
+	var images []api.ImageImportSpec
+	for tag, tagRef := range stream.Spec.Tags {
+		if !tagRef.ImportPolicy.Scheduled || tagRef.From == nil || tagRef.From.Kind != "DockerImage" {
+			continue
+		}
+		images = append(images, api.ImageImportSpec{From: *tagRef.From})
+		tags = append(tags, tag)
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	isi = &api.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{Name: stream.Name, Namespace: stream.Namespace},
+		Spec:       api.ImageStreamImportSpec{Import: true, Images: images},
+	}
+	return isi, tags
+}
+
+// applyImportResult records a TagEvent on stream for each successfully imported tag in
+// tags whose manifest digest differs from the most recently recorded one, and persists
+// the status in a single call. Tags whose digest is unchanged are left untouched, so that
+// a scheduled import which finds nothing new produces no write and no watch traffic. It
+// reports whether any tag actually changed.
+func (c *ImportController) applyImportResult(stream *api.ImageStream, tags []string, isi *api.ImageStreamImport) (bool, error) {
+	changed := false
+	for i, status := range isi.Status.Images {
+		if i >= len(tags) || status.Status.Status != metav1.StatusSuccess || status.Image == nil {
+			continue
+		}
+		tag := tags[i]
+
+		digest := status.Image.Name
+		if ref, err := api.ParseDockerImageReference(status.Image.DockerImageReference); err == nil && len(ref.ID) > 0 {
+			digest = ref.ID
+		}
+
+		events := stream.Status.Tags[tag]
+		if len(events.Items) > 0 && events.Items[0].Image == digest {
+			continue
+		}
+
+		events.Items = append([]api.TagEvent{{
+			Created:              metav1.Now(),
+			DockerImageReference: status.Image.DockerImageReference,
+			Image:                digest,
+			Generation:           stream.Generation,
+		}}, events.Items...)
+		if stream.Status.Tags == nil {
+			stream.Status.Tags = make(map[string]api.TagEventList)
+		}
+		stream.Status.Tags[tag] = events
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+	_, err := c.streams.ImageStreams(stream.Namespace).UpdateStatus(stream)
+	return true, err
+}
+
+// recordMissingCredentials sets an ImportSuccess=False/MissingCredentials condition on
+// tag and persists the stream's status, so that the UI and needsImport can see that the
+// cycle was skipped rather than silently dropped.
+func (c *ImportController) recordMissingCredentials(stream *api.ImageStream, tag string) error {
+	events := stream.Status.Tags[tag]
+	if cond := latestImportCondition(events); cond != nil && cond.Reason == missingCredentialsReason && cond.Generation == stream.Generation {
+		return nil
+	}
+
+	events.Conditions = append([]api.TagEventCondition{{
+		Type:       api.ImportSuccess,
+		Status:     kapi.ConditionFalse,
+		Reason:     missingCredentialsReason,
+		Message:    "the registry referenced by this tag has no usable pull credential",
+		Generation: stream.Generation,
+	}}, events.Conditions...)
+	if stream.Status.Tags == nil {
+		stream.Status.Tags = make(map[string]api.TagEventList)
+	}
+	stream.Status.Tags[tag] = events
+
+	_, err := c.streams.ImageStreams(stream.Namespace).UpdateStatus(stream)
+	return err
+}
+
+// bumpGeneration advances the generation of every scheduled tag on stream, and of the
+// stream itself, so that after a pull secret rotation those tags count as needing a
+// fresh import (see needsImport). It does not touch the scheduled backoff state.
+func (c *ImportController) bumpGeneration(stream *api.ImageStream) error {
+	changed := false
+	for tag, tagRef := range stream.Spec.Tags {
+		if !tagRef.ImportPolicy.Scheduled {
+			continue
+		}
+		next := stream.Generation + 1
+		if tagRef.Generation == nil || *tagRef.Generation < next {
+			tagRef.Generation = &next
+			stream.Spec.Tags[tag] = tagRef
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	stream.Generation++
+	_, err := c.streams.ImageStreams(stream.Namespace).Update(stream)
+	return err
+}
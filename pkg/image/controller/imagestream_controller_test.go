@@ -8,6 +8,7 @@ import (
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/diff"
 	clientgotesting "k8s.io/client-go/testing"
 	kapi "k8s.io/kubernetes/pkg/api"
@@ -424,4 +425,525 @@ func TestScheduledImport(t *testing.T) {
 	if b.scheduler.Len() != 1 {
 		t.Fatalf("should have left scheduled: %#v", b.scheduler)
 	}
-}
\ No newline at end of file
+}
+
+// TestScheduledImportBackoff steps a fake clock through several consecutive failures of
+// the same scheduled import and verifies that only the expected subset of RunOnce
+// cycles actually reach the registry, and that the stream stays scheduled throughout.
+func TestScheduledImportBackoff(t *testing.T) {
+	one := int64(1)
+	stream := &api.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test", Namespace: "other", UID: "1", ResourceVersion: "1",
+		},
+		Spec: api.ImageStreamSpec{
+			Tags: map[string]api.TagReference{
+				"default": {
+					From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "mysql:latest"},
+					Generation:   &one,
+					ImportPolicy: api.TagImportPolicy{Scheduled: true},
+				},
+			},
+		},
+	}
+	failedImport := &api.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other"},
+		Status: api.ImageStreamImportStatus{
+			Images: []api.ImageImportStatus{{
+				Status: metav1.Status{Status: metav1.StatusFailure},
+			}},
+		},
+	}
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	fake := client.NewSimpleFake(stream, failedImport)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.clock = fakeClock
+
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	createCalls := func() int {
+		n := 0
+		for _, action := range fake.Actions() {
+			if action.Matches("create", "imagestreamimports") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// first failing cycle always runs
+	b.scheduler.RunOnce()
+	if calls := createCalls(); calls != 1 {
+		t.Fatalf("expected 1 create after first cycle, got %d", calls)
+	}
+
+	// immediately re-running should be suppressed by backoff - no new call
+	b.scheduler.RunOnce()
+	b.scheduler.RunOnce()
+	if calls := createCalls(); calls != 1 {
+		t.Fatalf("expected backoff to suppress retries, got %d calls", calls)
+	}
+
+	// advancing past the backoff window allows another attempt
+	fakeClock.Step(backoffCap)
+	b.scheduler.RunOnce()
+	if calls := createCalls(); calls != 2 {
+		t.Fatalf("expected 1 additional create after backoff elapsed, got %d", calls)
+	}
+
+	if b.scheduler.Len() != 1 {
+		t.Fatalf("expected stream to remain scheduled: %#v", b.scheduler)
+	}
+}
+
+// TestScheduledImportMissingCredentials verifies that a scheduled import whose registry
+// has no usable pull credential is skipped with a MissingCredentials condition instead of
+// being dispatched, that the miss is backed off like any other failure (rather than
+// retried at the undamped tick rate) and does not grow the condition list on every tick,
+// and that a newly appearing secret bumps the tag generation so a later cycle - once the
+// backoff window has elapsed - imports immediately.
+func TestScheduledImportMissingCredentials(t *testing.T) {
+	one := int64(1)
+	newStream := func() *api.ImageStream {
+		return &api.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1", Generation: 1},
+			Spec: api.ImageStreamSpec{
+				Tags: map[string]api.TagReference{
+					"default": {
+						From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "myregistry.example.com/mysql:latest"},
+						Generation:   &one,
+						ImportPolicy: api.TagImportPolicy{Scheduled: true},
+					},
+				},
+			},
+		}
+	}
+
+	withSecrets := func(fake *client.Fake, list *kapi.SecretList) {
+		fake.PrependReactor("get", "imagestreams", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "secrets" {
+				return false, nil, nil
+			}
+			return true, list, nil
+		})
+	}
+
+	countUpdates := func(fake *client.Fake) int {
+		n := 0
+		for _, action := range fake.Actions() {
+			if action.Matches("update", "imagestreams") {
+				n++
+			}
+		}
+		return n
+	}
+
+	stream := newStream()
+	fake := client.NewSimpleFake(stream)
+	withSecrets(fake, &kapi.SecretList{})
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	b := newScheduled(true, fake, 1, NewSecretResolver(fake), nil)
+	b.clock = fakeClock
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+
+	for _, action := range fake.Actions() {
+		if action.Matches("create", "imagestreamimports") {
+			t.Fatalf("should not have imported without a usable credential: %#v", fake.Actions())
+		}
+	}
+	if n := countUpdates(fake); n != 1 {
+		t.Fatalf("expected exactly 1 status update recording the missing credential, got %d: %#v", n, fake.Actions())
+	}
+
+	// repeated ticks before the backoff window elapses must not re-dispatch the check
+	// or grow the condition list - this is the failure-rate problem chunk0-1 fixed.
+	b.scheduler.RunOnce()
+	b.scheduler.RunOnce()
+	if n := countUpdates(fake); n != 1 {
+		t.Fatalf("expected backoff to suppress repeated MissingCredentials updates, got %d: %#v", n, fake.Actions())
+	}
+
+	// a secret for the right registry appears, but the backoff window has not elapsed
+	// yet - the stale credential state must not be re-checked immediately.
+	stream = newStream()
+	fake = client.NewSimpleFake(stream)
+	withSecrets(fake, &kapi.SecretList{Items: []kapi.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pull-secret", Namespace: "other", ResourceVersion: "5"},
+		Type:       kapi.SecretTypeDockercfg,
+		Data:       map[string][]byte{".dockercfg": []byte(`{"myregistry.example.com":{}}`)},
+	}}})
+	b.controller.streams = fake
+	b.controller.secrets = NewSecretResolver(fake)
+	b.scheduler.RunOnce()
+	for _, action := range fake.Actions() {
+		if action.Matches("create", "imagestreamimports") {
+			t.Fatalf("should not have imported while still backed off: %#v", fake.Actions())
+		}
+	}
+
+	// once the backoff window elapses, the new credential is picked up
+	fakeClock.Step(backoffCap)
+	b.scheduler.RunOnce()
+
+	found := false
+	for _, action := range fake.Actions() {
+		if action.Matches("create", "imagestreamimports") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected scheduled import once backoff elapsed and a usable credential appeared: %#v", fake.Actions())
+	}
+}
+
+// TestScheduledRepositoryScan covers whole-repository tag discovery: a new upstream tag
+// is imported, a disappeared upstream tag is only pruned when the stream opts in, and a
+// transient registry error leaves the existing status untouched.
+func TestScheduledRepositoryScan(t *testing.T) {
+	newStream := func(prune bool) *api.ImageStream {
+		stream := &api.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+			Spec: api.ImageStreamSpec{
+				DockerImageRepository: "registry.example.com/test/other",
+			},
+			Status: api.ImageStreamStatus{
+				Tags: map[string]api.TagEventList{
+					"old": {Items: []api.TagEvent{{Image: "sha256:old"}}},
+				},
+			},
+		}
+		if prune {
+			stream.Annotations = map[string]string{repositoryPruneAnnotation: "true"}
+		}
+		return stream
+	}
+
+	hasAction := func(fake *client.Fake, verb, resource string) bool {
+		for _, action := range fake.Actions() {
+			if action.Matches(verb, resource) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// new upstream tag appears and is imported
+	stream := newStream(false)
+	fake := client.NewSimpleFake(stream)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.controller.registry = &fakeDockerRegistryClient{Tags: map[string]string{"old": "sha256:old", "latest": "sha256:new"}}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	if !hasAction(fake, "create", "imagestreamimports") {
+		t.Fatalf("expected new upstream tag to be imported: %#v", fake.Actions())
+	}
+
+	// upstream tag disappears, no prune annotation: status is left alone
+	stream = newStream(false)
+	fake = client.NewSimpleFake(stream)
+	b = newScheduled(true, fake, 1, nil, nil)
+	b.controller.registry = &fakeDockerRegistryClient{Tags: map[string]string{}}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	if hasAction(fake, "update", "imagestreams") {
+		t.Fatalf("did not expect status to change without the prune annotation: %#v", fake.Actions())
+	}
+
+	// upstream tag disappears, prune annotation set: status tag is removed
+	stream = newStream(true)
+	fake = client.NewSimpleFake(stream)
+	b = newScheduled(true, fake, 1, nil, nil)
+	b.controller.registry = &fakeDockerRegistryClient{Tags: map[string]string{}}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	if !hasAction(fake, "update", "imagestreams") {
+		t.Fatalf("expected disappeared tag to be pruned: %#v", fake.Actions())
+	}
+
+	// transient registry error leaves status untouched
+	stream = newStream(false)
+	fake = client.NewSimpleFake(stream)
+	b = newScheduled(true, fake, 1, nil, nil)
+	b.controller.registry = &fakeDockerRegistryClient{Err: fmt.Errorf("registry unavailable")}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	if hasAction(fake, "create", "imagestreamimports") || hasAction(fake, "update", "imagestreams") {
+		t.Fatalf("transient error should not have mutated the stream: %#v", fake.Actions())
+	}
+}
+
+// TestScheduledRepositoryScanConverges verifies that once a discovered upstream tag's
+// digest has been recorded in Status, a later scan of the same unchanged upstream tag set
+// does not re-import it - without this, repository scanning would never converge and
+// would re-issue an ImageStreamImport for every tag on every repositoryScanInterval tick,
+// forever.
+func TestScheduledRepositoryScanConverges(t *testing.T) {
+	stream := &api.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+		Spec: api.ImageStreamSpec{
+			DockerImageRepository: "registry.example.com/test/other",
+		},
+	}
+	imported := &api.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other"},
+		Status: api.ImageStreamImportStatus{
+			Images: []api.ImageImportStatus{{
+				Status: metav1.Status{Status: metav1.StatusSuccess},
+				Image:  &api.Image{DockerImageReference: "registry.example.com/test/other@sha256:new"},
+			}},
+		},
+	}
+
+	countActions := func(fake *client.Fake, verb, resource string) int {
+		n := 0
+		for _, action := range fake.Actions() {
+			if action.Matches(verb, resource) {
+				n++
+			}
+		}
+		return n
+	}
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	fake := client.NewSimpleFake(stream, imported)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.clock = fakeClock
+	b.controller.registry = &fakeDockerRegistryClient{Tags: map[string]string{"latest": "sha256:new"}}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	b.scheduler.RunOnce()
+	if n := countActions(fake, "create", "imagestreamimports"); n != 1 {
+		t.Fatalf("expected 1 create for the first scan, got %d: %#v", n, fake.Actions())
+	}
+	if n := countActions(fake, "update", "imagestreams"); n != 1 {
+		t.Fatalf("expected exactly 1 status update recording the discovered tag, got %d: %#v", n, fake.Actions())
+	}
+
+	// the same upstream tag set, scanned again once the pacing interval elapses, must
+	// not be re-imported now that its digest is recorded in Status.
+	fakeClock.Step(repositoryScanInterval)
+	b.scheduler.RunOnce()
+	if n := countActions(fake, "create", "imagestreamimports"); n != 1 {
+		t.Fatalf("expected scanning to converge on an unchanged upstream tag set, got %d creates: %#v", n, fake.Actions())
+	}
+}
+
+// TestScheduledRepositoryAndTagImport verifies that a stream which both scans a whole
+// repository and opts an explicit tag into scheduled import runs both mechanisms in the
+// same cycle, rather than the repository scan silently shadowing the tag's own scheduled
+// import.
+func TestScheduledRepositoryAndTagImport(t *testing.T) {
+	one := int64(1)
+	stream := &api.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+		Spec: api.ImageStreamSpec{
+			DockerImageRepository: "registry.example.com/test/other",
+			Tags: map[string]api.TagReference{
+				"pinned": {
+					From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "mysql:latest"},
+					Generation:   &one,
+					ImportPolicy: api.TagImportPolicy{Scheduled: true},
+				},
+			},
+		},
+	}
+
+	fake := client.NewSimpleFake(stream)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.controller.registry = &fakeDockerRegistryClient{Tags: map[string]string{"latest": "sha256:new"}}
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+
+	creates := 0
+	for _, action := range fake.Actions() {
+		if action.Matches("create", "imagestreamimports") {
+			creates++
+		}
+	}
+	if creates != 2 {
+		t.Fatalf("expected both the repository scan and the scheduled tag import to fire, got %d creates: %#v", creates, fake.Actions())
+	}
+}
+
+// TestScheduledImportThrottled verifies that a rate limiter with no available capacity
+// prevents a scheduled import from reaching the registry while leaving the stream
+// scheduled for a later attempt.
+func TestScheduledImportThrottled(t *testing.T) {
+	one := int64(1)
+	stream := &api.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+		Spec: api.ImageStreamSpec{
+			Tags: map[string]api.TagReference{
+				"default": {
+					From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "mysql:latest"},
+					Generation:   &one,
+					ImportPolicy: api.TagImportPolicy{Scheduled: true},
+				},
+			},
+		},
+	}
+
+	fake := client.NewSimpleFake(stream)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.controller.SetRateLimit(0, time.Minute, 0)
+
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+
+	for _, action := range fake.Actions() {
+		if action.Matches("create", "imagestreamimports") {
+			t.Fatalf("expected no create actions while throttled: %#v", fake.Actions())
+		}
+	}
+	if b.scheduler.Len() != 1 {
+		t.Fatalf("expected stream to remain scheduled while throttled: %#v", b.scheduler)
+	}
+}
+
+// TestScheduledImportPerRegistryRateLimit verifies that a scheduled batch spanning two
+// upstream registries charges each tag to its own registry's bucket, so a tag whose
+// registry is out of tokens is deferred while a tag bound for a different, unthrottled
+// registry still imports in the same cycle.
+func TestScheduledImportPerRegistryRateLimit(t *testing.T) {
+	one := int64(1)
+	stream := &api.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+		Spec: api.ImageStreamSpec{
+			Tags: map[string]api.TagReference{
+				"a": {
+					From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "registry-a.example.com/foo:latest"},
+					Generation:   &one,
+					ImportPolicy: api.TagImportPolicy{Scheduled: true},
+				},
+				"b": {
+					From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "registry-b.example.com/bar:latest"},
+					Generation:   &one,
+					ImportPolicy: api.TagImportPolicy{Scheduled: true},
+				},
+			},
+		},
+	}
+
+	fake := client.NewSimpleFake(stream)
+	b := newScheduled(true, fake, 1, nil, nil)
+	b.controller.SetRateLimit(1, time.Minute, 0)
+	b.controller.limiter.Allow("other|registry-a.example.com")
+
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+
+	var imported []string
+	for _, action := range fake.Actions() {
+		create, ok := action.(clientgotesting.CreateAction)
+		if !ok || !action.Matches("create", "imagestreamimports") {
+			continue
+		}
+		isi, ok := create.GetObject().(*api.ImageStreamImport)
+		if !ok {
+			continue
+		}
+		for _, image := range isi.Spec.Images {
+			imported = append(imported, image.From.Name)
+		}
+	}
+	if len(imported) != 1 || imported[0] != "registry-b.example.com/bar:latest" {
+		t.Fatalf("expected only the tag bound for the non-throttled registry to import, got %v: %#v", imported, fake.Actions())
+	}
+}
+
+// TestScheduledImportIdempotentStatus verifies that a scheduled import whose returned
+// digest matches the most recently recorded one produces no status update, and that a
+// changed digest still results in exactly one.
+func TestScheduledImportIdempotentStatus(t *testing.T) {
+	one := int64(1)
+	newStream := func(lastDigest string) *api.ImageStream {
+		return &api.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other", ResourceVersion: "1"},
+			Spec: api.ImageStreamSpec{
+				Tags: map[string]api.TagReference{
+					"default": {
+						From:         &kapi.ObjectReference{Kind: "DockerImage", Name: "mysql:latest"},
+						Generation:   &one,
+						ImportPolicy: api.TagImportPolicy{Scheduled: true},
+					},
+				},
+			},
+			Status: api.ImageStreamStatus{
+				Tags: map[string]api.TagEventList{
+					"default": {Items: []api.TagEvent{{Image: lastDigest}}},
+				},
+			},
+		}
+	}
+	importWithDigest := func(digest string) *api.ImageStreamImport {
+		return &api.ImageStreamImport{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "other"},
+			Status: api.ImageStreamImportStatus{
+				Images: []api.ImageImportStatus{{
+					Status: metav1.Status{Status: metav1.StatusSuccess},
+					Image:  &api.Image{DockerImageReference: "docker.io/library/mysql@" + digest},
+				}},
+			},
+		}
+	}
+	countActions := func(fake *client.Fake, verb, resource string) int {
+		n := 0
+		for _, action := range fake.Actions() {
+			if action.Matches(verb, resource) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// unchanged digest: two cycles, two creates, zero updates
+	stream := newStream("sha256:aaa")
+	fake := client.NewSimpleFake(stream, importWithDigest("sha256:aaa"))
+	b := newScheduled(true, fake, 1, nil, nil)
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	b.scheduler.RunOnce()
+	if n := countActions(fake, "create", "imagestreamimports"); n != 2 {
+		t.Fatalf("expected 2 creates, got %d: %#v", n, fake.Actions())
+	}
+	if n := countActions(fake, "update", "imagestreams"); n != 0 {
+		t.Fatalf("expected 0 status updates for an unchanged digest, got %d: %#v", n, fake.Actions())
+	}
+
+	// changed digest: status is updated once
+	stream = newStream("sha256:aaa")
+	fake = client.NewSimpleFake(stream, importWithDigest("sha256:bbb"))
+	b = newScheduled(true, fake, 1, nil, nil)
+	if err := b.Handle(stream); err != nil {
+		t.Fatal(err)
+	}
+	b.scheduler.RunOnce()
+	if n := countActions(fake, "update", "imagestreams"); n != 1 {
+		t.Fatalf("expected 1 status update for a changed digest, got %d: %#v", n, fake.Actions())
+	}
+}
@@ -0,0 +1,25 @@
+package controller
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	importsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "image_import_controller",
+		Name:      "imports_total",
+		Help:      "Number of scheduled or repository-scan imports successfully dispatched.",
+	})
+	importsThrottledTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "image_import_controller",
+		Name:      "imports_throttled_total",
+		Help:      "Number of scheduled import cycles skipped because no rate limit token or in-flight slot was available.",
+	})
+	importsFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "image_import_controller",
+		Name:      "imports_failed_total",
+		Help:      "Number of scheduled or repository-scan imports that failed, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(importsTotal, importsThrottledTotal, importsFailedTotal)
+}
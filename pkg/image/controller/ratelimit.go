@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// rateLimiter is a token bucket keyed by an arbitrary string (namespace + upstream
+// registry host, in this package) that refills to capacity every window. A capacity of
+// zero never allows a request through, which is useful for tests and for disabling a
+// registry entirely.
+type rateLimiter struct {
+	lock     sync.Mutex
+	capacity int
+	window   time.Duration
+	clock    clock.Clock
+	buckets  map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  int
+	resetAt time.Time
+}
+
+// newRateLimiter returns a rateLimiter that allows up to capacity requests per key every
+// window.
+func newRateLimiter(capacity int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		capacity: capacity,
+		window:   window,
+		clock:    clock.RealClock{},
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// Allow consumes a token for key if one is available, returning whether the caller may
+// proceed.
+func (r *rateLimiter) Allow(key string) bool {
+	if r.capacity <= 0 {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	bucket, ok := r.buckets[key]
+	if !ok || !now.Before(bucket.resetAt) {
+		bucket = &tokenBucket{tokens: r.capacity, resetAt: now.Add(r.window)}
+		r.buckets[key] = bucket
+	}
+	if bucket.tokens <= 0 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// inFlightLimiter bounds how many imports may be in progress across every namespace and
+// registry at once. ImportController treats a nil *inFlightLimiter as no bound; the
+// methods themselves require a non-nil receiver.
+type inFlightLimiter struct {
+	slots chan struct{}
+}
+
+// newInFlightLimiter returns a limiter allowing up to max concurrent imports.
+func newInFlightLimiter(max int) *inFlightLimiter {
+	return &inFlightLimiter{slots: make(chan struct{}, max)}
+}
+
+// TryAcquire claims a slot without blocking, returning whether one was available.
+func (l *inFlightLimiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release returns a slot claimed by TryAcquire.
+func (l *inFlightLimiter) Release() {
+	<-l.slots
+}
@@ -0,0 +1,422 @@
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	osclient "github.com/openshift/origin/pkg/client"
+	"github.com/openshift/origin/pkg/image/api"
+)
+
+const (
+	// backoffBase is the delay used after the first consecutive failure of a
+	// scheduled import.
+	backoffBase = 30 * time.Second
+	// backoffCap bounds the exponential delay before jitter is applied, no matter how
+	// many consecutive failures have accumulated; with jitter the actual deferral can
+	// exceed it by up to backoffJitter.
+	backoffCap = 1 * time.Hour
+	// backoffJitter is the fraction of the computed delay that is randomized in
+	// either direction, to keep failing streams from retrying in lockstep.
+	backoffJitter = 0.2
+
+	// repositoryScanInterval is the minimum time between successful whole-repository
+	// tag discovery scans for the same stream.
+	repositoryScanInterval = 5 * time.Minute
+)
+
+// cacheKey identifies a single ImageStream within the scheduler, independent of the
+// resource version used as the scheduler's value for that key.
+type cacheKey struct {
+	namespace, name string
+}
+
+// backoffState tracks the consecutive failure count and earliest retry time for a
+// single scheduled stream.
+type backoffState struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+// scheduled periodically re-imports ImageStreams whose tags have opted into scheduled
+// background import, backing off streams whose imports keep failing.
+type scheduled struct {
+	enabled bool
+
+	controller *ImportController
+	scheduler  *scheduler
+
+	clock clock.Clock
+
+	lock           sync.Mutex
+	backoff        map[cacheKey]*backoffState
+	secretVersions map[cacheKey]string
+	lastPolled     map[cacheKey]time.Time
+	nextScan       map[cacheKey]time.Time
+}
+
+// newScheduled returns a scheduled import runner for streams. If enabled is false,
+// Handle is a no-op. parallelImports is passed to the underlying scheduler, which does
+// not use it: RunOnce processes scheduled streams one at a time. secrets, when non-nil, is consulted before each scheduled import
+// to short-circuit streams with missing or rotated credentials. defaultRegistry is
+// reserved for resolving a default registry for scheduled imports.
+func newScheduled(enabled bool, streams osclient.Interface, parallelImports int, secrets SecretResolver, defaultRegistry DefaultRegistryFunc) *scheduled {
+	b := &scheduled{
+		enabled:        enabled,
+		controller:     &ImportController{streams: streams, secrets: secrets},
+		clock:          clock.RealClock{},
+		backoff:        make(map[cacheKey]*backoffState),
+		secretVersions: make(map[cacheKey]string),
+		lastPolled:     make(map[cacheKey]time.Time),
+		nextScan:       make(map[cacheKey]time.Time),
+	}
+	b.scheduler = newScheduler(parallelImports, b.processKey)
+	return b
+}
+
+// Handle schedules stream for periodic background import if any of its tags request
+// scheduled import, or if it discovers tags from a whole Docker repository.
+func (b *scheduled) Handle(stream *api.ImageStream) error {
+	if !b.enabled {
+		return nil
+	}
+	if !hasScheduledTag(stream) && len(stream.Spec.DockerImageRepository) == 0 {
+		return nil
+	}
+	b.scheduler.Add(cacheKey{namespace: stream.Namespace, name: stream.Name}, stream.ResourceVersion)
+	return nil
+}
+
+// hasScheduledTag reports whether any spec tag on stream has opted into scheduled
+// import.
+func hasScheduledTag(stream *api.ImageStream) bool {
+	for _, tagRef := range stream.Spec.Tags {
+		if tagRef.ImportPolicy.Scheduled {
+			return true
+		}
+	}
+	return false
+}
+
+// processKey is invoked by the scheduler for each scheduled stream in turn. It re-reads
+// the stream, skips the cycle if the stream is still backed off from a prior failure,
+// submits a scheduled import otherwise, and adjusts the backoff state from the outcome.
+func (b *scheduled) processKey(key, value interface{}) {
+	k := key.(cacheKey)
+
+	if state := b.backoffFor(k); state != nil && b.clock.Now().Before(state.nextAttempt) {
+		b.scheduler.Add(key, value)
+		return
+	}
+
+	stream, err := b.controller.streams.ImageStreams(k.namespace).Get(k.name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		b.scheduler.Remove(key, value)
+		b.clearBackoff(k)
+		return
+	}
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to check scheduled import for %s/%s: %v", k.namespace, k.name, err))
+		importsFailedTotal.WithLabelValues("get_stream").Inc()
+		b.recordFailure(k)
+		b.scheduler.Add(key, value)
+		return
+	}
+
+	if usable, err := b.checkCredentials(k, stream); err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to resolve secrets for %s/%s: %v", k.namespace, k.name, err))
+		importsFailedTotal.WithLabelValues("secret_resolution").Inc()
+		b.recordFailure(k)
+		b.scheduler.Add(key, stream.ResourceVersion)
+		return
+	} else if !usable {
+		importsFailedTotal.WithLabelValues("missing_credentials").Inc()
+		b.recordFailure(k)
+		b.scheduler.Add(key, stream.ResourceVersion)
+		return
+	}
+
+	// A stream may both scan a whole repository and opt individual tags into scheduled
+	// import; the two mechanisms are independent and both run every cycle. Repository
+	// scans pace themselves to repositoryScanInterval via nextScan rather than the
+	// shared backoff state, so running one never starves the other.
+	if len(stream.Spec.DockerImageRepository) > 0 {
+		b.processRepositoryScan(k, stream)
+	}
+	if hasScheduledTag(stream) {
+		b.processScheduledTags(k, stream)
+	}
+
+	b.scheduler.Add(key, stream.ResourceVersion)
+}
+
+// processScheduledTags submits an import covering every tag on stream that opted into
+// scheduled import and currently has a rate limit token available, deferring any tag
+// whose registry is out of tokens to a later cycle, and records the outcome as a backoff
+// success or failure.
+func (b *scheduled) processScheduledTags(k cacheKey, stream *api.ImageStream) {
+	isi, tags := b.controller.scheduledImport(stream)
+	if isi == nil {
+		b.clearBackoff(k)
+		return
+	}
+
+	allowed := b.controller.allowImport(k.namespace, isi.Spec.Images)
+	if len(allowed) == 0 {
+		importsThrottledTotal.Inc()
+		return
+	}
+	defer b.controller.releaseImport()
+	if len(allowed) < len(isi.Spec.Images) {
+		isi, tags = subsetImport(isi, tags, allowed)
+	}
+
+	created, err := b.controller.streams.ImageStreamImports(k.namespace).Create(isi)
+	switch {
+	case err != nil:
+		utilruntime.HandleError(fmt.Errorf("scheduled import of %s/%s failed: %v", k.namespace, k.name, err))
+		importsFailedTotal.WithLabelValues("error").Inc()
+		b.recordFailure(k)
+	case !importSucceeded(created):
+		importsFailedTotal.WithLabelValues("import_failed").Inc()
+		b.recordFailure(k)
+	default:
+		if _, err := b.controller.applyImportResult(stream, tags, created); err != nil {
+			utilruntime.HandleError(fmt.Errorf("recording scheduled import result for %s/%s failed: %v", k.namespace, k.name, err))
+			importsFailedTotal.WithLabelValues("status_update").Inc()
+			b.recordFailure(k)
+			return
+		}
+		importsTotal.Inc()
+		b.setLastPolled(k, b.clock.Now())
+		b.clearBackoff(k)
+	}
+}
+
+// processRepositoryScan discovers upstream tags for stream's Spec.DockerImageRepository,
+// imports whatever is new or changed, records the resulting digests in stream.Status so
+// the next scan sees them as unchanged, prunes status entries for tags that disappeared
+// upstream when the stream opts in, and paces the next scan by repositoryScanInterval on
+// success. A transient discovery error is treated as a backoff failure and never touches
+// stream.Status. It is a no-op if the previous scan's pacing interval has not elapsed yet.
+func (b *scheduled) processRepositoryScan(k cacheKey, stream *api.ImageStream) {
+	if !b.dueForScan(k) {
+		return
+	}
+
+	isi, tags, prune, err := b.controller.scanRepository(stream)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("repository scan of %s/%s failed: %v", k.namespace, k.name, err))
+		importsFailedTotal.WithLabelValues("scan_error").Inc()
+		b.recordFailure(k)
+		return
+	}
+
+	if isi != nil {
+		allowed := b.controller.allowImport(k.namespace, isi.Spec.Images)
+		if len(allowed) == 0 {
+			importsThrottledTotal.Inc()
+			return
+		}
+		if len(allowed) < len(isi.Spec.Images) {
+			isi, tags = subsetImport(isi, tags, allowed)
+		}
+		created, err := b.controller.streams.ImageStreamImports(k.namespace).Create(isi)
+		b.controller.releaseImport()
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("repository scan import of %s/%s failed: %v", k.namespace, k.name, err))
+			importsFailedTotal.WithLabelValues("error").Inc()
+			b.recordFailure(k)
+			return
+		}
+		if !importSucceeded(created) {
+			importsFailedTotal.WithLabelValues("import_failed").Inc()
+			b.recordFailure(k)
+			return
+		}
+		if _, err := b.controller.applyImportResult(stream, tags, created); err != nil {
+			utilruntime.HandleError(fmt.Errorf("recording repository scan result for %s/%s failed: %v", k.namespace, k.name, err))
+			importsFailedTotal.WithLabelValues("status_update").Inc()
+			b.recordFailure(k)
+			return
+		}
+		importsTotal.Inc()
+	}
+
+	if err := b.controller.pruneTags(stream, prune); err != nil {
+		utilruntime.HandleError(fmt.Errorf("pruning disappeared tags for %s/%s failed: %v", k.namespace, k.name, err))
+		importsFailedTotal.WithLabelValues("prune_error").Inc()
+		b.recordFailure(k)
+		return
+	}
+
+	b.clearBackoff(k)
+	b.setLastPolled(k, b.clock.Now())
+	b.scheduleNext(k, repositoryScanInterval)
+}
+
+// importSucceeded reports whether every image in isi.Status succeeded.
+func importSucceeded(isi *api.ImageStreamImport) bool {
+	if isi == nil {
+		return false
+	}
+	for _, image := range isi.Status.Images {
+		if image.Status.Status != metav1.StatusSuccess {
+			return false
+		}
+	}
+	return true
+}
+
+// backoffFor returns the current backoff state for k, or nil if it is not backed off.
+func (b *scheduled) backoffFor(k cacheKey) *backoffState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.backoff[k]
+}
+
+// recordFailure increments the consecutive failure count for k and defers its next
+// attempt by an exponentially increasing, jittered delay.
+func (b *scheduled) recordFailure(k cacheKey) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state, ok := b.backoff[k]
+	if !ok {
+		state = &backoffState{}
+		b.backoff[k] = state
+	}
+	state.failures++
+	state.nextAttempt = b.clock.Now().Add(backoffDelay(state.failures))
+}
+
+// clearBackoff resets any accumulated backoff for k after a successful cycle.
+func (b *scheduled) clearBackoff(k cacheKey) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.backoff, k)
+}
+
+// setLastPolled records the time at which stream k was last successfully checked for an
+// import, regardless of whether that check produced a status write.
+func (b *scheduled) setLastPolled(k cacheKey, t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lastPolled[k] = t
+}
+
+// LastPolledAt returns the time at which namespace/name was last successfully checked for
+// a scheduled import, or the zero time if it never has been.
+func (b *scheduled) LastPolledAt(namespace, name string) time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lastPolled[cacheKey{namespace: namespace, name: name}]
+}
+
+// dueForScan reports whether k's repository scan pacing interval, if any was set by a
+// prior scheduleNext call, has elapsed.
+func (b *scheduled) dueForScan(k cacheKey) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	next, ok := b.nextScan[k]
+	return !ok || !b.clock.Now().Before(next)
+}
+
+// scheduleNext paces k's next repository scan no sooner than interval from now. This is
+// independent of the failure backoff state so that it never delays the unrelated
+// per-tag scheduled imports that may run against the same stream.
+func (b *scheduled) scheduleNext(k cacheKey, interval time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nextScan[k] = b.clock.Now().Add(interval)
+}
+
+// checkCredentials resolves the secrets linked to the stream named by k and reports
+// whether every scheduled tag has a usable pull credential. Tags that don't have one are
+// recorded with a MissingCredentials condition. If the resolved secret set differs from
+// the one last observed for k, the stream's scheduled tags are bumped to a new generation
+// so they count as needing a fresh import. processKey only calls this on a cycle that is
+// not backed off, so a rotation is noticed once k's current backoff window has elapsed.
+func (b *scheduled) checkCredentials(k cacheKey, stream *api.ImageStream) (bool, error) {
+	if b.controller.secrets == nil {
+		return true, nil
+	}
+
+	list, err := b.controller.secrets.Secrets(k.namespace, k.name)
+	if err != nil {
+		return false, err
+	}
+
+	fingerprint := secretsFingerprint(list)
+	previous, seen := b.secretVersionFor(k)
+	rotated := seen && previous != fingerprint
+	b.rememberSecretVersion(k, fingerprint)
+
+	usable := true
+	for tag, tagRef := range stream.Spec.Tags {
+		if !tagRef.ImportPolicy.Scheduled || tagRef.From == nil || tagRef.From.Kind != "DockerImage" {
+			continue
+		}
+		ref, err := api.ParseDockerImageReference(tagRef.From.Name)
+		if err != nil {
+			continue
+		}
+		if hasCredentialFor(list, ref.Registry) {
+			continue
+		}
+		usable = false
+		if err := b.controller.recordMissingCredentials(stream, tag); err != nil {
+			return false, err
+		}
+	}
+
+	if rotated {
+		if err := b.controller.bumpGeneration(stream); err != nil {
+			return usable, err
+		}
+	}
+
+	return usable, nil
+}
+
+// secretVersionFor returns the fingerprint last observed for k and whether one has been
+// recorded at all.
+func (b *scheduled) secretVersionFor(k cacheKey) (string, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	v, ok := b.secretVersions[k]
+	return v, ok
+}
+
+// rememberSecretVersion records fingerprint as the most recently observed secret state
+// for k.
+func (b *scheduled) rememberSecretVersion(k cacheKey, fingerprint string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.secretVersions[k] = fingerprint
+}
+
+// backoffDelay computes min(backoffCap, backoffBase*2^(failures-1)) and then applies up
+// to +/-backoffJitter of random jitter.
+func backoffDelay(failures int) time.Duration {
+	delay := backoffBase
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= backoffCap {
+			delay = backoffCap
+			break
+		}
+	}
+	jitter := time.Duration((rand.Float64()*2 - 1) * backoffJitter * float64(delay))
+	delay += jitter
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
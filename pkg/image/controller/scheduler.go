@@ -0,0 +1,73 @@
+package controller
+
+import "sync"
+
+// scheduler is a minimal, in-memory work queue keyed by an opaque identity value (such
+// as a namespace/name pair) and versioned by an opaque value (such as a resource
+// version). Callers use Add to enqueue or refresh an item, RunOnce to process every
+// currently scheduled item, and Remove to perform a compare-and-delete that only
+// succeeds if the stored value still matches what the caller last observed - this
+// protects against a concurrent Add (for example, from a fresh watch event) racing with
+// a RunOnce that is still processing the prior version of the same item.
+type scheduler struct {
+	lock sync.Mutex
+	keys map[interface{}]interface{}
+
+	process func(key, value interface{})
+}
+
+// newScheduler returns a scheduler that invokes process for every item each time RunOnce
+// is called. parallel is accepted for future use in bounding concurrent processing and is
+// currently unused.
+func newScheduler(parallel int, process func(key, value interface{})) *scheduler {
+	return &scheduler{
+		keys:    make(map[interface{}]interface{}),
+		process: process,
+	}
+}
+
+// Add enqueues key with value, overwriting any previously scheduled value for key.
+func (s *scheduler) Add(key, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[key] = value
+}
+
+// Remove deletes key from the schedule only if its current value still equals value,
+// reporting whether the removal happened.
+func (s *scheduler) Remove(key, value interface{}) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if current, ok := s.keys[key]; !ok || current != value {
+		return false
+	}
+	delete(s.keys, key)
+	return true
+}
+
+// Len returns the number of items currently scheduled.
+func (s *scheduler) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.keys)
+}
+
+// Map returns a snapshot of the currently scheduled key/value pairs.
+func (s *scheduler) Map() map[interface{}]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make(map[interface{}]interface{}, len(s.keys))
+	for k, v := range s.keys {
+		out[k] = v
+	}
+	return out
+}
+
+// RunOnce processes a snapshot of every currently scheduled item. Items added to or
+// removed from the schedule by process (including the item currently being processed)
+// take effect for the next call to RunOnce.
+func (s *scheduler) RunOnce() {
+	for key, value := range s.Map() {
+		s.process(key, value)
+	}
+}
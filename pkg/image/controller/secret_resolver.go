@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	osclient "github.com/openshift/origin/pkg/client"
+	"github.com/openshift/origin/pkg/image/api"
+)
+
+// missingCredentialsReason is recorded on a tag's ImportSuccess condition when the
+// scheduled importer could not find a usable pull credential for the tag's registry.
+const missingCredentialsReason = "MissingCredentials"
+
+// SecretResolver locates the pull secrets linked to an ImageStream so a scheduled import
+// can detect, without making a remote registry call, that its credentials have been
+// rotated or removed.
+type SecretResolver interface {
+	Secrets(namespace, name string) (*kapi.SecretList, error)
+}
+
+// clientSecretResolver resolves secrets through the ImageStreamSecrets REST path.
+type clientSecretResolver struct {
+	streams osclient.Interface
+}
+
+// NewSecretResolver returns a SecretResolver backed by the given client.
+func NewSecretResolver(streams osclient.Interface) SecretResolver {
+	return &clientSecretResolver{streams: streams}
+}
+
+func (r *clientSecretResolver) Secrets(namespace, name string) (*kapi.SecretList, error) {
+	return r.streams.ImageStreamSecrets(namespace).Secrets(name, metav1.ListOptions{})
+}
+
+// dockerConfigEntry is a single registry's credentials within a dockercfg-style secret.
+// Only the key matters for hasCredentialFor, so the credential fields themselves are
+// never inspected.
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// dockerConfigJSON is the shape of a kubernetes.io/dockerconfigjson secret's
+// .dockerconfigjson entry, as produced by `docker login`.
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// hasCredentialFor reports whether secrets contains a dockercfg-style secret with an
+// auth entry keyed by registry.
+func hasCredentialFor(secrets *kapi.SecretList, registry string) bool {
+	if secrets == nil {
+		return false
+	}
+	for _, secret := range secrets.Items {
+		var auths map[string]dockerConfigEntry
+		switch secret.Type {
+		case kapi.SecretTypeDockercfg:
+			if err := json.Unmarshal(secret.Data[kapi.DockerConfigKey], &auths); err != nil {
+				continue
+			}
+		case kapi.SecretTypeDockerConfigJson:
+			var cfg dockerConfigJSON
+			if err := json.Unmarshal(secret.Data[kapi.DockerConfigJsonKey], &cfg); err != nil {
+				continue
+			}
+			auths = cfg.Auths
+		default:
+			continue
+		}
+		for host := range auths {
+			if dockerConfigHostMatches(host, registry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dockerConfigHostMatches reports whether a dockercfg auth key - which may carry a URL
+// scheme and path, e.g. "https://index.docker.io/v1/" - refers to registry.
+func dockerConfigHostMatches(key, registry string) bool {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	return host == registry
+}
+
+// secretsFingerprint returns a value that changes whenever the set of secrets, or any of
+// their resource versions, changes - used to detect rotation without diffing contents.
+func secretsFingerprint(secrets *kapi.SecretList) string {
+	if secrets == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, secret := range secrets.Items {
+		b.WriteString(secret.Namespace)
+		b.WriteByte('/')
+		b.WriteString(secret.Name)
+		b.WriteByte('@')
+		b.WriteString(secret.ResourceVersion)
+		b.WriteByte(';')
+	}
+	return b.String()
+}